@@ -0,0 +1,268 @@
+// Package config resolves the MySQL data source name used by the rest of
+// the tool, supporting a full DSN, discrete my.cnf-style connection flags
+// (including TLS), and, as a last resort, the Debian /etc/mysql/debian.cnf
+// socket credentials this tool originally shipped with.
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/ini.v1"
+)
+
+// Options collects every way the caller can describe how to reach MySQL.
+// Resolve picks the first source that applies, in this order: DSN, then
+// Host/Socket, then the Debian config file.
+type Options struct {
+	// DSN, if set, is used verbatim and every other field is ignored.
+	DSN string
+
+	// Host enables a TCP connection; use bracket notation for IPv6
+	// addresses (e.g. "::1" or "[::1]"). Socket enables a unix socket
+	// connection. Setting either one takes this path instead of the Debian
+	// config file fallback.
+	Host   string
+	Port   string
+	Socket string
+
+	User     string
+	Password string
+
+	// SSLMode is one of "disabled" (default), "preferred", "required",
+	// "verify_ca", or "verify_identity".
+	SSLMode string
+	SSLCA   string
+	SSLCert string
+	SSLKey  string
+
+	ParseTime bool
+	Loc       string
+
+	Timeout      time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// DebianConfigPath is used only when neither DSN nor Host/Socket is set.
+	DebianConfigPath string
+}
+
+// Resolve turns opts into a go-sql-driver/mysql DSN.
+func Resolve(opts Options) (string, error) {
+	if opts.DSN != "" {
+		return opts.DSN, nil
+	}
+
+	if opts.Host != "" || opts.Socket != "" {
+		return hostDSN(opts)
+	}
+
+	return debianDSN(opts)
+}
+
+func hostDSN(opts Options) (string, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = opts.User
+	cfg.Passwd = opts.Password
+
+	if opts.Socket != "" {
+		cfg.Net = "unix"
+		cfg.Addr = opts.Socket
+	} else {
+		port := opts.Port
+		if port == "" {
+			port = "3306"
+		}
+
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(opts.Host, port)
+	}
+
+	if err := applyConnKnobs(cfg, opts); err != nil {
+		return "", err
+	}
+
+	if err := applyTLS(cfg, opts); err != nil {
+		return "", err
+	}
+
+	return cfg.FormatDSN(), nil
+}
+
+func debianDSN(opts Options) (string, error) {
+	cfgMap, err := readDebianMySQLConfig(opts.DebianConfigPath)
+	if err != nil {
+		return "", err
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = cfgMap["user"]
+	cfg.Passwd = cfgMap["password"]
+	cfg.Net = "unix"
+	cfg.Addr = cfgMap["socket"]
+
+	if err := applyConnKnobs(cfg, opts); err != nil {
+		return "", err
+	}
+
+	return cfg.FormatDSN(), nil
+}
+
+func applyConnKnobs(cfg *mysql.Config, opts Options) error {
+	cfg.ParseTime = opts.ParseTime
+	cfg.Timeout = opts.Timeout
+	cfg.ReadTimeout = opts.ReadTimeout
+	cfg.WriteTimeout = opts.WriteTimeout
+
+	if opts.Loc != "" {
+		loc, err := time.LoadLocation(opts.Loc)
+		if err != nil {
+			return err
+		}
+
+		cfg.Loc = loc
+	}
+
+	return nil
+}
+
+// applyTLS registers a *tls.Config with mysql.RegisterTLSConfig when the
+// requested SSLMode needs one, and points cfg.TLSConfig at it.
+func applyTLS(cfg *mysql.Config, opts Options) error {
+	mode := opts.SSLMode
+	if mode == "" {
+		mode = "disabled"
+	}
+
+	switch mode {
+	case "disabled":
+		return nil
+
+	case "preferred":
+		cfg.TLSConfig = "preferred"
+		return nil
+
+	case "required", "verify_ca", "verify_identity":
+		tlsConfig, err := buildTLSConfig(opts)
+		if err != nil {
+			return err
+		}
+
+		switch mode {
+		case "required":
+			tlsConfig.InsecureSkipVerify = true
+		case "verify_ca":
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyPeerCertificate = verifyCAOnly(tlsConfig.RootCAs)
+		}
+
+		name := "mysql-lock-helper-" + mode
+
+		if err := mysql.RegisterTLSConfig(name, tlsConfig); err != nil {
+			return err
+		}
+
+		cfg.TLSConfig = name
+
+		return nil
+
+	default:
+		return fmt.Errorf("config: unsupported ssl-mode %q", opts.SSLMode)
+	}
+}
+
+func buildTLSConfig(opts Options) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if opts.SSLCA != "" {
+		pem, err := os.ReadFile(opts.SSLCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("config: failed to parse CA certificate %s", opts.SSLCA)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.SSLCert != "" && opts.SSLKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.SSLCert, opts.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyCAOnly builds a VerifyPeerCertificate callback that checks the
+// server certificate chains up to roots, without verifying the hostname
+// (used for ssl-mode=verify_ca, which intentionally skips identity checks).
+func verifyCAOnly(roots *x509.CertPool) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("config: no certificate presented by server")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+
+		return err
+	}
+}
+
+func readDebianMySQLConfig(path string) (map[string]string, error) {
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{
+		Insensitive:         true,
+		IgnoreInlineComment: true,
+		AllowBooleanKeys:    true},
+		path)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	cfg.BlockMode = false
+
+	clientSection := cfg.Section("client")
+	if clientSection == nil {
+		return map[string]string{}, errors.New("failed to get mysql client configuration")
+	}
+
+	if !clientSection.HasKey("host") ||
+		!clientSection.HasKey("user") ||
+		!clientSection.HasKey("password") ||
+		!clientSection.HasKey("socket") {
+		return map[string]string{}, errors.New("failed to get mysql client configuration")
+	}
+
+	return clientSection.KeysHash(), nil
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestHostDSNTCP(t *testing.T) {
+	dsn, err := hostDSN(Options{
+		Host:     "db.example.com",
+		Port:     "3307",
+		User:     "backup",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatalf("hostDSN: %v", err)
+	}
+
+	if !strings.Contains(dsn, "tcp(db.example.com:3307)") {
+		t.Errorf("hostDSN = %q, want tcp(db.example.com:3307)", dsn)
+	}
+
+	if !strings.HasPrefix(dsn, "backup:secret@") {
+		t.Errorf("hostDSN = %q, want user:password prefix", dsn)
+	}
+}
+
+func TestHostDSNDefaultPort(t *testing.T) {
+	dsn, err := hostDSN(Options{Host: "127.0.0.1", User: "backup"})
+	if err != nil {
+		t.Fatalf("hostDSN: %v", err)
+	}
+
+	if !strings.Contains(dsn, "tcp(127.0.0.1:3306)") {
+		t.Errorf("hostDSN = %q, want default port 3306", dsn)
+	}
+}
+
+func TestHostDSNIPv6(t *testing.T) {
+	dsn, err := hostDSN(Options{Host: "::1", User: "backup"})
+	if err != nil {
+		t.Fatalf("hostDSN: %v", err)
+	}
+
+	if !strings.Contains(dsn, "tcp([::1]:3306)") {
+		t.Errorf("hostDSN = %q, want bracketed IPv6 address", dsn)
+	}
+}
+
+func TestHostDSNSocket(t *testing.T) {
+	dsn, err := hostDSN(Options{Socket: "/var/run/mysqld/mysqld.sock", User: "backup"})
+	if err != nil {
+		t.Fatalf("hostDSN: %v", err)
+	}
+
+	if !strings.Contains(dsn, "unix(/var/run/mysqld/mysqld.sock)") {
+		t.Errorf("hostDSN = %q, want unix socket address", dsn)
+	}
+}
+
+func TestApplyTLSDisabled(t *testing.T) {
+	cfg := mysql.NewConfig()
+
+	if err := applyTLS(cfg, Options{SSLMode: ""}); err != nil {
+		t.Fatalf("applyTLS: %v", err)
+	}
+
+	if cfg.TLSConfig != "" {
+		t.Errorf("TLSConfig = %q, want empty for disabled mode", cfg.TLSConfig)
+	}
+}
+
+func TestApplyTLSPreferred(t *testing.T) {
+	cfg := mysql.NewConfig()
+
+	if err := applyTLS(cfg, Options{SSLMode: "preferred"}); err != nil {
+		t.Fatalf("applyTLS: %v", err)
+	}
+
+	if cfg.TLSConfig != "preferred" {
+		t.Errorf("TLSConfig = %q, want %q", cfg.TLSConfig, "preferred")
+	}
+}
+
+func TestApplyTLSUnsupportedMode(t *testing.T) {
+	cfg := mysql.NewConfig()
+
+	if err := applyTLS(cfg, Options{SSLMode: "bogus"}); err == nil {
+		t.Fatal("applyTLS accepted an unsupported ssl-mode")
+	}
+}
+
+func TestApplyTLSRequiredRegistersConfig(t *testing.T) {
+	cfg := mysql.NewConfig()
+
+	if err := applyTLS(cfg, Options{SSLMode: "required"}); err != nil {
+		t.Fatalf("applyTLS: %v", err)
+	}
+
+	if cfg.TLSConfig != "mysql-lock-helper-required" {
+		t.Errorf("TLSConfig = %q, want registered name", cfg.TLSConfig)
+	}
+}
+
+func TestDebianDSN(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "debian.cnf")
+
+	contents := "[client]\nhost     = localhost\nuser     = debian-sys-maint\npassword = s3cr3t\nsocket   = /var/run/mysqld/mysqld.sock\n"
+
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("writing debian.cnf fixture: %v", err)
+	}
+
+	dsn, err := debianDSN(Options{DebianConfigPath: path})
+	if err != nil {
+		t.Fatalf("debianDSN: %v", err)
+	}
+
+	if !strings.Contains(dsn, "debian-sys-maint:s3cr3t@unix(/var/run/mysqld/mysqld.sock)") {
+		t.Errorf("debianDSN = %q, want socket credentials from debian.cnf", dsn)
+	}
+}
+
+func TestDebianDSNMissingKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "debian.cnf")
+
+	if err := os.WriteFile(path, []byte("[client]\nhost = localhost\n"), 0o600); err != nil {
+		t.Fatalf("writing debian.cnf fixture: %v", err)
+	}
+
+	if _, err := debianDSN(Options{DebianConfigPath: path}); err == nil {
+		t.Fatal("debianDSN accepted a config file missing required keys")
+	}
+}
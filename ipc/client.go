@@ -0,0 +1,35 @@
+package ipc
+
+import (
+	"net"
+
+	"github.com/s3rj1k/mysql-lock-helper/logging"
+)
+
+// Do dials socket, sends req signed with secret, and returns the server's
+// response.
+func Do(socket string, secret []byte, req Request) (Response, error) {
+
+	c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return Response{}, err
+	}
+
+	defer func() {
+		if err := c.Close(); err != nil {
+			logging.Warn("defer_failed", "close", nil, 0, err)
+		}
+	}()
+
+	if err := writeFrame(c, req, secret); err != nil {
+		return Response{}, err
+	}
+
+	var resp Response
+
+	if err := readFrame(c, secret, &resp); err != nil {
+		return Response{}, err
+	}
+
+	return resp, nil
+}
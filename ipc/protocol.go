@@ -0,0 +1,190 @@
+// Package ipc implements the authenticated control protocol spoken over the
+// unix socket between a running "-lock-tables" process and the
+// "-unlock-tables" (or status/extend) client: a 4-byte big-endian
+// length-prefixed frame carrying a JSON payload, with an HMAC over the
+// payload so only a holder of the shared secret can control the lock.
+package ipc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/s3rj1k/mysql-lock-helper/lock"
+)
+
+// Command names a typed request.
+type Command string
+
+const (
+	// CommandStatus asks for the current lock state.
+	CommandStatus Command = "status"
+
+	// CommandUnlock releases the lock and shuts the server down.
+	CommandUnlock Command = "unlock"
+
+	// CommandExtendLock records that the caller wants the lock held longer,
+	// for reporting purposes.
+	CommandExtendLock Command = "extend_lock"
+
+	// CommandShutdown releases the lock and shuts the server down, same as
+	// CommandUnlock, for clients that want an explicit "emergency stop" verb.
+	CommandShutdown Command = "shutdown"
+)
+
+// Request is the client-to-server frame payload.
+type Request struct {
+	Command Command `json:"command"`
+}
+
+// Response is the server-to-client frame payload.
+type Response struct {
+	OK             bool           `json:"ok"`
+	Error          string         `json:"error,omitempty"`
+	LockHeld       bool           `json:"lock_held"`
+	Tables         []string       `json:"tables,omitempty"`
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	ExtendCount    int            `json:"extend_count"`
+	Position       *lock.Position `json:"position,omitempty"`
+}
+
+// maxFrameBytes bounds the length prefix so a misbehaving peer can't make us
+// allocate an unbounded buffer.
+const maxFrameBytes = 1 << 20
+
+// envelope wraps a JSON payload with an HMAC-SHA256 over that payload, so a
+// frame can be authenticated before it's unmarshaled.
+type envelope struct {
+	Payload json.RawMessage `json:"payload"`
+	MAC     string          `json:"mac"`
+}
+
+func sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(secret, payload []byte, mac string) bool {
+	got, err := hex.DecodeString(mac)
+	if err != nil {
+		return false
+	}
+
+	h := hmac.New(sha256.New, secret)
+	h.Write(payload)
+
+	return hmac.Equal(got, h.Sum(nil))
+}
+
+// writeFrame signs v with secret and writes it to w as a length-prefixed
+// frame.
+func writeFrame(w io.Writer, v interface{}, secret []byte) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	env := envelope{Payload: payload, MAC: sign(secret, payload)}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+
+	return err
+}
+
+// readFrame reads a length-prefixed frame from r, verifies its HMAC against
+// secret, and unmarshals the payload into v.
+func readFrame(r io.Reader, secret []byte, v interface{}) error {
+	var length [4]byte
+
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxFrameBytes {
+		return fmt.Errorf("ipc: frame of %d bytes exceeds the %d byte limit", n, maxFrameBytes)
+	}
+
+	data := make([]byte, n)
+
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	var env envelope
+
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+
+	if !verify(secret, env.Payload, env.MAC) {
+		return errors.New("ipc: invalid HMAC, rejecting frame")
+	}
+
+	return json.Unmarshal(env.Payload, v)
+}
+
+// LoadOrCreateSecret reads the HMAC shared secret from path, creating it
+// with a random value and mode 0600 if it doesn't exist yet. An existing
+// file that isn't mode 0600 is rejected.
+func LoadOrCreateSecret(path string) ([]byte, error) {
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		info, statErr := os.Stat(path)
+		if statErr != nil {
+			return nil, statErr
+		}
+
+		if info.Mode().Perm() != 0o600 {
+			return nil, fmt.Errorf("ipc: secret file %s must be mode 0600, got %#o", path, info.Mode().Perm())
+		}
+
+		return hex.DecodeString(strings.TrimSpace(string(data)))
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(secret)), 0o600); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// elapsedSince is a small helper kept here so both server and client code can
+// report durations consistently.
+func elapsedSince(t time.Time) float64 {
+	return time.Since(t).Seconds()
+}
@@ -0,0 +1,92 @@
+package ipc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	secret := []byte("shared-secret")
+	payload := []byte(`{"command":"status"}`)
+
+	mac := sign(secret, payload)
+
+	if !verify(secret, payload, mac) {
+		t.Fatal("verify rejected a MAC it just signed")
+	}
+}
+
+func TestVerifyRejectsTamperedPayload(t *testing.T) {
+	secret := []byte("shared-secret")
+	payload := []byte(`{"command":"status"}`)
+
+	mac := sign(secret, payload)
+
+	if verify(secret, []byte(`{"command":"unlock"}`), mac) {
+		t.Fatal("verify accepted a MAC for a different payload")
+	}
+}
+
+func TestVerifyRejectsWrongSecret(t *testing.T) {
+	payload := []byte(`{"command":"status"}`)
+
+	mac := sign([]byte("secret-a"), payload)
+
+	if verify([]byte("secret-b"), payload, mac) {
+		t.Fatal("verify accepted a MAC signed with a different secret")
+	}
+}
+
+func TestVerifyRejectsMalformedMAC(t *testing.T) {
+	secret := []byte("shared-secret")
+	payload := []byte(`{"command":"status"}`)
+
+	if verify(secret, payload, "not-hex!!") {
+		t.Fatal("verify accepted a non-hex MAC")
+	}
+}
+
+func TestWriteReadFrameRoundTrip(t *testing.T) {
+	secret := []byte("shared-secret")
+	req := Request{Command: CommandExtendLock}
+
+	var buf bytes.Buffer
+
+	if err := writeFrame(&buf, req, secret); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	var got Request
+
+	if err := readFrame(&buf, secret, &got); err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+
+	if got.Command != req.Command {
+		t.Errorf("readFrame got command %q, want %q", got.Command, req.Command)
+	}
+}
+
+func TestReadFrameRejectsTamperedMAC(t *testing.T) {
+	secret := []byte("shared-secret")
+	req := Request{Command: CommandUnlock}
+
+	var buf bytes.Buffer
+
+	if err := writeFrame(&buf, req, secret); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	data := buf.Bytes()
+	// Flip a byte inside the frame body, after the 4-byte length prefix, so
+	// the MAC no longer matches the payload it was attached to.
+	if len(data) > 5 {
+		data[5] ^= 0xFF
+	}
+
+	var got Request
+
+	if err := readFrame(bytes.NewReader(data), secret, &got); err == nil {
+		t.Fatal("readFrame accepted a frame with a tampered body")
+	}
+}
@@ -0,0 +1,179 @@
+package ipc
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/s3rj1k/mysql-lock-helper/lock"
+	"github.com/s3rj1k/mysql-lock-helper/logging"
+	"github.com/s3rj1k/mysql-lock-helper/metrics"
+)
+
+// Server answers control requests about a lock currently held by the
+// process that created it.
+type Server struct {
+	secret    []byte
+	tables    []string
+	startedAt time.Time
+	position  *lock.Position
+	release   func() error
+
+	mu          sync.Mutex
+	extendCount int
+	released    bool
+	releaseErr  error
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewServer creates a Server reporting on a lock over tables, captured at
+// position (which may be nil if it wasn't captured). release is called
+// synchronously, at most once, by the Unlock/Shutdown handler, before it
+// acknowledges the command — so a client that sees LockHeld:false knows the
+// lock has actually been released, not merely that a signal was sent.
+func NewServer(secret []byte, tables []string, position *lock.Position, release func() error) *Server {
+	return &Server{
+		secret:    secret,
+		tables:    tables,
+		startedAt: time.Now(),
+		position:  position,
+		release:   release,
+		done:      make(chan struct{}),
+	}
+}
+
+// Done returns a channel that's closed once an Unlock or Shutdown command
+// has finished releasing the lock (successfully or not).
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// ReleaseErr returns the error (if any) returned by release. It's only
+// meaningful after Done has been closed.
+func (s *Server) ReleaseErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.releaseErr
+}
+
+// Serve accepts connections on l, handling one request per connection, until
+// l is closed.
+func (s *Server) Serve(l *net.UnixListener) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+
+		s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn *net.UnixConn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logging.Warn("defer_failed", "close", nil, 0, err)
+		}
+	}()
+
+	var req Request
+
+	if err := readFrame(conn, s.secret, &req); err != nil {
+		logging.Warn("read_frame_failed", "serve", nil, 0, err)
+		return
+	}
+
+	resp := s.dispatch(req)
+
+	if err := writeFrame(conn, resp, s.secret); err != nil {
+		logging.Warn("write_frame_failed", "serve", nil, 0, err)
+	}
+}
+
+func (s *Server) dispatch(req Request) Response {
+	metrics.SocketCommandsTotal.WithLabelValues(string(req.Command)).Inc()
+
+	switch req.Command {
+	case CommandStatus:
+		s.mu.Lock()
+		extendCount := s.extendCount
+		s.mu.Unlock()
+
+		return Response{
+			OK:             true,
+			LockHeld:       true,
+			Tables:         s.tables,
+			ElapsedSeconds: elapsedSince(s.startedAt),
+			ExtendCount:    extendCount,
+			Position:       s.position,
+		}
+
+	case CommandExtendLock:
+		s.mu.Lock()
+		s.extendCount++
+		s.mu.Unlock()
+
+		return Response{OK: true, LockHeld: true}
+
+	case CommandUnlock, CommandShutdown:
+		s.mu.Lock()
+		if !s.released {
+			s.released = true
+			s.releaseErr = s.release()
+		}
+		releaseErr := s.releaseErr
+		s.mu.Unlock()
+
+		s.doneOnce.Do(func() { close(s.done) })
+
+		if releaseErr != nil {
+			return Response{OK: false, LockHeld: true, Error: releaseErr.Error()}
+		}
+
+		return Response{OK: true, LockHeld: false}
+
+	default:
+		return Response{OK: false, Error: "ipc: unknown command " + string(req.Command)}
+	}
+}
+
+// ListenUnix creates socket with mode 0660, optionally chowned to group, and
+// starts listening on it.
+func ListenUnix(socket string, group string) (*net.UnixListener, error) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(socket, 0o660); err != nil {
+		return nil, err
+	}
+
+	if group != "" {
+		gid, err := groupID(group)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.Chown(socket, -1, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func groupID(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(g.Gid)
+}
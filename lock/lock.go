@@ -0,0 +1,359 @@
+// Package lock implements the MySQL-side locking primitives used to put a
+// server into a consistent state for a backup: the classic MyISAM read lock,
+// plus the lower-impact InnoDB-aware alternatives available on newer
+// servers. It also captures the replication coordinate (binlog file/position
+// and GTID_EXECUTED) at the moment a lock is held.
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/s3rj1k/mysql-lock-helper/logging"
+)
+
+// Mode selects how the server is put into a backup-consistent state.
+type Mode string
+
+const (
+	// ModeMyISAM issues "FLUSH TABLES <tables> WITH READ LOCK", locking only
+	// the given MyISAM tables.
+	ModeMyISAM Mode = "myisam"
+
+	// ModeInstance issues "LOCK INSTANCE FOR BACKUP" (MySQL 8.0+), which
+	// blocks DDL and table-level metadata changes but not DML.
+	ModeInstance Mode = "instance"
+
+	// ModeGlobal issues a plain "FLUSH TABLES WITH READ LOCK", locking every
+	// table on the server.
+	ModeGlobal Mode = "global"
+
+	// ModeSnapshot starts "START TRANSACTION WITH CONSISTENT SNAPSHOT" on a
+	// dedicated connection, suitable for InnoDB-only backups.
+	ModeSnapshot Mode = "snapshot"
+)
+
+// ParseMode validates a -lock-mode flag value.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case ModeMyISAM, ModeInstance, ModeGlobal, ModeSnapshot:
+		return Mode(s), nil
+	default:
+		return "", fmt.Errorf("lock: unsupported lock mode %q", s)
+	}
+}
+
+// Lock represents a held server-side lock. Release must be called to put the
+// server back into a normal state.
+type Lock struct {
+	mode Mode
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+// Acquire puts the server into a backup-consistent state according to mode.
+// tables is only consulted for ModeMyISAM. ctx bounds how long Acquire waits
+// for the server, so a hung connection can't leave the caller blocked
+// forever before any lock is actually held.
+func Acquire(ctx context.Context, db *sql.DB, mode Mode, tables []string) (*Lock, error) {
+
+	switch mode {
+	case ModeMyISAM:
+		if len(tables) == 0 {
+			return nil, errors.New("lock: myisam mode requires at least one table")
+		}
+
+		stmt := fmt.Sprintf("FLUSH TABLES %s WITH READ LOCK;", strings.Join(tables, ", "))
+
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+
+		return &Lock{mode: mode, db: db}, nil
+
+	case ModeGlobal:
+		if _, err := db.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK;"); err != nil {
+			return nil, err
+		}
+
+		return &Lock{mode: mode, db: db}, nil
+
+	case ModeInstance:
+		version, err := ServerVersion(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+
+		if isMariaDB(version) {
+			return nil, fmt.Errorf("lock: LOCK INSTANCE FOR BACKUP is not supported on MariaDB, server reports %q", version)
+		}
+
+		if !ServerSupportsInstanceLock(version) {
+			return nil, fmt.Errorf("lock: LOCK INSTANCE FOR BACKUP requires MySQL 8.0+, server reports %q", version)
+		}
+
+		if _, err := db.ExecContext(ctx, "LOCK INSTANCE FOR BACKUP;"); err != nil {
+			return nil, err
+		}
+
+		return &Lock{mode: mode, db: db}, nil
+
+	case ModeSnapshot:
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT;"); err != nil {
+			if cerr := conn.Close(); cerr != nil {
+				logging.Warn("defer_failed", "snapshot_acquire", nil, 0, cerr)
+			}
+
+			return nil, err
+		}
+
+		return &Lock{mode: mode, db: db, conn: conn}, nil
+
+	default:
+		return nil, fmt.Errorf("lock: unsupported lock mode %q", mode)
+	}
+}
+
+// Release puts the server back into a normal state.
+func (l *Lock) Release() error {
+	switch l.mode {
+	case ModeMyISAM, ModeGlobal:
+		_, err := l.db.Exec("UNLOCK TABLES;")
+		return err
+
+	case ModeInstance:
+		_, err := l.db.Exec("UNLOCK INSTANCE;")
+		return err
+
+	case ModeSnapshot:
+		_, err := l.conn.ExecContext(context.Background(), "COMMIT;")
+
+		if cerr := l.conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+
+		return err
+
+	default:
+		return fmt.Errorf("lock: unsupported lock mode %q", l.mode)
+	}
+}
+
+// Queryer is satisfied by both *sql.DB and *sql.Conn, so CapturePosition can
+// run against either the connection pool or the dedicated connection a
+// ModeSnapshot lock holds open.
+type Queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Queryer returns the connection the lock is held on, for use with
+// CapturePosition: the dedicated connection for ModeSnapshot, or the pool for
+// every other mode.
+func (l *Lock) Queryer() Queryer {
+	if l.conn != nil {
+		return l.conn
+	}
+
+	return l.db
+}
+
+// MyISAMTables lists every MyISAM base table on the server, excluding the
+// mysql and performance_schema schemas. ctx bounds how long the query may
+// run.
+func MyISAMTables(ctx context.Context, db *sql.DB) ([]string, error) {
+
+	var tables []string
+
+	sql := `SELECT
+            CONCAT(TABLE_SCHEMA, '.', TABLE_NAME)
+          FROM information_schema.TABLES
+          WHERE TABLE_TYPE='BASE TABLE'
+            AND TABLE_SCHEMA
+                NOT IN ('mysql', 'performance_schema')
+            AND ENGINE='MyISAM';`
+
+	rows, err := db.QueryContext(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logging.Warn("defer_failed", "close", nil, 0, err)
+		}
+	}()
+
+	for rows.Next() {
+
+		var table string
+
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, table)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tables, nil
+}
+
+// ServerVersion returns the result of SELECT VERSION().
+func ServerVersion(ctx context.Context, db *sql.DB) (string, error) {
+	var version string
+
+	if err := db.QueryRowContext(ctx, "SELECT VERSION();").Scan(&version); err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
+// ServerSupportsInstanceLock reports whether a SELECT VERSION() result
+// indicates MySQL 8.0 or newer, the minimum required for
+// LOCK INSTANCE FOR BACKUP. MariaDB never supports it: MariaDB's
+// SELECT VERSION() reports a MySQL-compatible major.minor (e.g.
+// "10.11.6-MariaDB"), which would otherwise pass the numeric check even
+// though MariaDB has no LOCK INSTANCE FOR BACKUP statement.
+func ServerSupportsInstanceLock(version string) bool {
+	if isMariaDB(version) {
+		return false
+	}
+
+	major, minor, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+
+	return major > 8 || (major == 8 && minor >= 0)
+}
+
+// isMariaDB reports whether a SELECT VERSION() result identifies the server
+// as MariaDB rather than MySQL.
+func isMariaDB(version string) bool {
+	return strings.Contains(strings.ToLower(version), "mariadb")
+}
+
+func parseVersion(version string) (major, minor int, ok bool) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return major, minor, true
+}
+
+// Position is a replication coordinate captured while a lock is held, so a
+// backup can be resumed from a known-consistent point.
+type Position struct {
+	ServerVersion string `json:"server_version"`
+	BinlogFile    string `json:"binlog_file,omitempty"`
+	BinlogPos     uint64 `json:"binlog_position,omitempty"`
+	GTIDExecuted  string `json:"gtid_executed,omitempty"`
+}
+
+// CapturePosition reads SHOW MASTER STATUS and @@GLOBAL.GTID_EXECUTED from q.
+// Call it while a Lock is held so the coordinate is consistent with the
+// backup.
+func CapturePosition(ctx context.Context, q Queryer) (*Position, error) {
+
+	pos := &Position{}
+
+	if err := q.QueryRowContext(ctx, "SELECT VERSION();").Scan(&pos.ServerVersion); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, "SHOW MASTER STATUS;")
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logging.Warn("defer_failed", "close", nil, 0, err)
+		}
+	}()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	if rows.Next() {
+
+		dest := make([]sql.RawBytes, len(cols))
+		ptrs := make([]interface{}, len(cols))
+
+		for i := range dest {
+			ptrs[i] = &dest[i]
+		}
+
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		for i, col := range cols {
+			switch strings.ToLower(col) {
+			case "file":
+				pos.BinlogFile = string(dest[i])
+			case "position":
+				p, err := strconv.ParseUint(string(dest[i]), 10, 64)
+				if err != nil {
+					return nil, err
+				}
+
+				pos.BinlogPos = p
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// GTID_EXECUTED can be empty when GTID mode is off; that's not an error.
+	var gtid sql.NullString
+
+	if err := q.QueryRowContext(ctx, "SELECT @@GLOBAL.GTID_EXECUTED;").Scan(&gtid); err != nil {
+		return nil, err
+	}
+
+	pos.GTIDExecuted = gtid.String
+
+	return pos, nil
+}
+
+// WritePositionFile writes pos as indented JSON to path with mode 0640.
+func WritePositionFile(path string, pos *Position) error {
+	data, err := json.MarshalIndent(pos, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0640)
+}
@@ -0,0 +1,96 @@
+package lock
+
+import "testing"
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Mode
+		wantErr bool
+	}{
+		{"myisam", ModeMyISAM, false},
+		{"instance", ModeInstance, false},
+		{"global", ModeGlobal, false},
+		{"snapshot", ModeSnapshot, false},
+		{"bogus", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMode(tt.in)
+
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseMode(%q): expected error, got nil", tt.in)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseMode(%q): unexpected error: %v", tt.in, err)
+		}
+
+		if got != tt.want {
+			t.Errorf("ParseMode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version   string
+		wantMajor int
+		wantMinor int
+		wantOK    bool
+	}{
+		{"8.0.34", 8, 0, true},
+		{"8.0.34-log", 8, 0, true},
+		{"5.7.44", 5, 7, true},
+		{"10.11.6-MariaDB-1:10.11.6+maria~ubu2204", 10, 11, true},
+		{"bogus", 0, 0, false},
+		{"8", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		major, minor, ok := parseVersion(tt.version)
+
+		if ok != tt.wantOK {
+			t.Errorf("parseVersion(%q) ok = %v, want %v", tt.version, ok, tt.wantOK)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		if major != tt.wantMajor || minor != tt.wantMinor {
+			t.Errorf("parseVersion(%q) = (%d, %d), want (%d, %d)", tt.version, major, minor, tt.wantMajor, tt.wantMinor)
+		}
+	}
+}
+
+func TestServerSupportsInstanceLock(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"8.0.34", true},
+		{"8.0.34-log", true},
+		{"8.1.0", true},
+		{"5.7.44", false},
+		{"5.7.44-log", false},
+		// MariaDB reports a MySQL-compatible major.minor but never supports
+		// LOCK INSTANCE FOR BACKUP.
+		{"10.11.6-MariaDB-1:10.11.6+maria~ubu2204", false},
+		{"11.2.2-MariaDB", false},
+		{"bogus", false},
+	}
+
+	for _, tt := range tests {
+		got := ServerSupportsInstanceLock(tt.version)
+		if got != tt.want {
+			t.Errorf("ServerSupportsInstanceLock(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Package logging provides the process-wide structured JSON logger for lock
+// lifecycle events, so multiple nightly invocations can be graphed and
+// alerted on instead of grepped out of plain-text log lines.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Logger is the process-wide structured logger. It writes JSON to stderr.
+var Logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+// Info logs a lock lifecycle event at info level. tables and duration may be
+// left nil/zero when not applicable to the event.
+func Info(event, phase string, tables []string, duration time.Duration, err error) {
+	record(slog.LevelInfo, event, phase, tables, duration, err)
+}
+
+// Warn logs a lock lifecycle event at warn level, typically a failure that
+// doesn't abort the current operation (e.g. a deferred cleanup call).
+func Warn(event, phase string, tables []string, duration time.Duration, err error) {
+	record(slog.LevelWarn, event, phase, tables, duration, err)
+}
+
+// Error logs a lock lifecycle event at error level, typically a failure that
+// does abort the current operation.
+func Error(event, phase string, tables []string, duration time.Duration, err error) {
+	record(slog.LevelError, event, phase, tables, duration, err)
+}
+
+func record(level slog.Level, event, phase string, tables []string, duration time.Duration, err error) {
+	args := make([]any, 0, 8)
+
+	args = append(args, "event", event, "phase", phase)
+
+	if tables != nil {
+		args = append(args, "tables", tables)
+	}
+
+	if duration != 0 {
+		args = append(args, "duration_ms", duration.Milliseconds())
+	}
+
+	if err != nil {
+		args = append(args, "err", err.Error())
+	}
+
+	Logger.Log(context.Background(), level, event, args...)
+}
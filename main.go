@@ -1,184 +1,244 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"strings"
 	"time"
 
-	"gopkg.in/ini.v1"
-
 	"database/sql"
-	"github.com/go-sql-driver/mysql"
+	"encoding/json"
+
+	"github.com/s3rj1k/mysql-lock-helper/config"
+	"github.com/s3rj1k/mysql-lock-helper/ipc"
+	"github.com/s3rj1k/mysql-lock-helper/lock"
+	"github.com/s3rj1k/mysql-lock-helper/logging"
+	"github.com/s3rj1k/mysql-lock-helper/metrics"
+	"github.com/s3rj1k/mysql-lock-helper/runner"
 )
 
-func readDebianMySQLConfig(path string) (map[string]string, error) {
+// envFlag collects repeated "-run-env KEY=VALUE" flags into a slice.
+type envFlag []string
 
-	cfg, err := ini.LoadSources(ini.LoadOptions{
-		Insensitive:         true,
-		IgnoreInlineComment: true,
-		AllowBooleanKeys:    true},
-		path)
-	if err != nil {
-		return map[string]string{}, err
-	}
-	cfg.BlockMode = false
-
-	clientSection := cfg.Section("client")
-	if clientSection == nil {
-		return map[string]string{}, errors.New("failed to get mysql client configuration")
-	}
+func (e *envFlag) String() string {
+	return strings.Join(*e, ",")
+}
 
-	if !clientSection.HasKey("host") ||
-		!clientSection.HasKey("user") ||
-		!clientSection.HasKey("password") ||
-		!clientSection.HasKey("socket") {
-		return map[string]string{}, errors.New("failed to get mysql client configuration")
-	}
+func (e *envFlag) Set(value string) error {
+	*e = append(*e, value)
 
-	return clientSection.KeysHash(), nil
+	return nil
 }
 
-func genDsn(cfgMap map[string]string) string {
-
-	cfg := mysql.NewConfig()
-	cfg.User = cfgMap["user"]
-	cfg.Passwd = cfgMap["password"]
-	cfg.Net = "unix"
-	cfg.Addr = cfgMap["socket"]
+// withOptionalTimeout wraps ctx with a timeout when d > 0, otherwise it
+// returns ctx unchanged with a no-op cancel.
+func withOptionalTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
 
-	return cfg.FormatDSN()
+	return context.WithTimeout(ctx, d)
 }
 
-func getMyISAMTables(dsn string) ([]string, error) {
-
-	var err error
-	var tables []string
+// discoverTables lists the MyISAM tables to lock for mode, or nil for modes
+// that don't operate on a fixed table list.
+func discoverTables(ctx context.Context, dsn string, mode lock.Mode) ([]string, error) {
+	if mode != lock.ModeMyISAM {
+		return nil, nil
+	}
 
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		return []string{}, err
+		return nil, err
 	}
 
 	defer func() {
-		err := db.Close()
-		if err != nil {
-			log.Printf("failed to defer: %s\n", err.Error())
+		if err := db.Close(); err != nil {
+			logging.Warn("defer_failed", "close", nil, 0, err)
 		}
 	}()
 
-	err = db.Ping()
+	return lock.MyISAMTables(ctx, db)
+}
+
+// lockOptions configures how lockTables sets up the socket that a separate
+// "-unlock-tables" invocation uses to signal release.
+type lockOptions struct {
+	Mode           lock.Mode
+	Tables         []string
+	Socket         string
+	PositionFile   string
+	LegacyProtocol bool
+	SecretFile     string
+	SocketGroup    string
+}
+
+func lockTables(ctx context.Context, dsn string, opts lockOptions) error {
+
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		return []string{}, err
+		return err
 	}
 
-	sql := `SELECT
-            CONCAT(TABLE_SCHEMA, '.', TABLE_NAME)
-          FROM information_schema.TABLES
-          WHERE TABLE_TYPE='BASE TABLE'
-            AND TABLE_SCHEMA
-                NOT IN ('mysql', 'performance_schema')
-            AND ENGINE='MyISAM';`
+	err = db.PingContext(ctx)
+	if err != nil {
+		return err
+	}
 
-	rows, err := db.Query(sql)
+	// to see locks on DB.TABLES issue this SQL: SHOW OPEN TABLES WHERE In_use > 0;
+	l, err := lock.Acquire(ctx, db, opts.Mode, opts.Tables)
 	if err != nil {
-		return []string{}, err
+		metrics.FlushErrorsTotal.Inc()
+		return err
 	}
 
+	lockedAt := time.Now()
+	metrics.LockHeld.Set(1)
+
+	if opts.Mode == lock.ModeMyISAM {
+		metrics.SetMyISAMTablesPerSchema(opts.Tables)
+	}
+
+	var position *lock.Position
+
+	if pos, err := lock.CapturePosition(ctx, l.Queryer()); err != nil {
+		logging.Warn("capture_position_failed", "locked", opts.Tables, 0, err)
+	} else {
+		position = pos
+
+		if err := reportPosition(pos, opts.PositionFile); err != nil {
+			logging.Warn("report_position_failed", "locked", opts.Tables, 0, err)
+		}
+	}
+
+	logging.Info("lock_acquired", "locked", opts.Tables, 0, nil)
+
 	defer func() {
-		err := rows.Close()
+		err := db.Close()
+		if err != nil {
+			logging.Warn("defer_failed", "close", nil, 0, err)
+		}
+	}()
+
+	defer func() {
+		err := os.Remove(opts.Socket)
 		if err != nil {
-			log.Printf("failed to defer: %s\n", err.Error())
+			logging.Warn("defer_failed", "remove_socket", nil, 0, err)
 		}
 	}()
 
-	for rows.Next() {
+	// releaseErr holds the outcome of the actual UNLOCK TABLES/UNLOCK
+	// INSTANCE/COMMIT call. For the authenticated protocol, that call is
+	// made synchronously by the ipc server before it acks the Unlock
+	// command, so release happens exactly once and l.Release() below must
+	// not be called again.
+	var releaseErr error
 
-		var table string
+	if opts.LegacyProtocol {
+		if err := waitForLegacyUnlock(db, opts.Socket); err != nil {
+			logging.Warn("wait_for_unlock_failed", "locked", opts.Tables, 0, err)
+		}
 
-		err = rows.Scan(&table)
+		releaseErr = l.Release()
+	} else {
+		rErr, err := waitForUnlock(opts, position, l.Release)
 		if err != nil {
-			return []string{}, err
+			logging.Warn("wait_for_unlock_failed", "locked", opts.Tables, 0, err)
+			releaseErr = l.Release()
+		} else {
+			releaseErr = rErr
 		}
-
-		tables = append(tables, table)
 	}
 
-	if err := rows.Err(); err != nil {
-		return []string{}, err
+	lockDuration := time.Since(lockedAt)
+	metrics.LockHeld.Set(0)
+	metrics.LockDurationSeconds.Observe(lockDuration.Seconds())
+
+	if releaseErr != nil {
+		logging.Warn("release_lock_failed", "unlock", opts.Tables, 0, releaseErr)
+	} else {
+		logging.Info("lock_released", "unlock", opts.Tables, lockDuration, nil)
 	}
 
-	return tables, nil
+	return nil
 }
 
-func lockMyISAMTables(dsn string, tables []string, socket string) error {
-
-	var err error
-
-	db, err := sql.Open("mysql", dsn)
+// waitForUnlock serves the authenticated ipc protocol until an Unlock or
+// Shutdown command has run release and acked it. setupErr is non-nil only
+// when the socket/secret couldn't be set up at all, in which case release
+// was never called and the caller must call it itself; releaseErr is the
+// result of release once the server has run it.
+func waitForUnlock(opts lockOptions, position *lock.Position, release func() error) (releaseErr error, setupErr error) {
+	secret, err := ipc.LoadOrCreateSecret(opts.SecretFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = db.Ping()
+	ln, err := ipc.ListenUnix(opts.Socket, opts.SocketGroup)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// to see locks on DB.TABLES issue this SQL: SHOW OPEN TABLES WHERE In_use > 0;
-	sql := fmt.Sprintf("FLUSH TABLES %s WITH READ LOCK;", strings.Join(tables, ", "))
+	defer func() {
+		if err := ln.Close(); err != nil {
+			logging.Warn("defer_failed", "close", nil, 0, err)
+		}
+	}()
 
-	_, err = db.Exec(sql)
-	if err != nil {
-		return err
-	}
+	srv := ipc.NewServer(secret, opts.Tables, position, release)
+
+	go srv.Serve(ln)
+
+	<-srv.Done()
+
+	return srv.ReleaseErr(), nil
+}
 
-	l, err := listenOnUnixSocket(socket)
+// waitForLegacyUnlock preserves the pre-ipc-package behavior for one
+// release, guarded by -legacy-protocol: an unauthenticated fixed-size read
+// loop that breaks once it sees the literal "UNLOCK_MYISAM_TABLES" string.
+func waitForLegacyUnlock(db *sql.DB, socket string) error {
+	ln, err := listenOnUnixSocket(socket)
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		err := db.Close()
-		if err != nil {
-			log.Printf("failed to defer: %s\n", err.Error())
-		}
-	}()
-
-	defer func() {
-		err := os.Remove(socket)
-		if err != nil {
-			log.Printf("failed to defer: %s\n", err.Error())
-		}
-	}()
-
 	for {
 		time.Sleep(100 * time.Millisecond)
-		err = db.Ping()
-		if err != nil {
-			log.Println(err.Error())
+
+		if err := db.Ping(); err != nil {
+			logging.Warn("ping_failed", "locked", nil, 0, err)
 		}
 
-		buf, err := readUnixSocket(l)
+		buf, err := readUnixSocket(ln)
 		if err != nil {
-			log.Println(err.Error())
-			break
+			return err
 		}
 
 		if strings.TrimSpace(buf) == "UNLOCK_MYISAM_TABLES" {
-			break
+			return nil
 		}
 	}
+}
 
-	_, err = db.Exec("UNLOCK TABLES;")
+// reportPosition writes pos to positionFile, or prints it to stdout as JSON
+// when positionFile is empty.
+func reportPosition(pos *lock.Position, positionFile string) error {
+	if positionFile != "" {
+		return lock.WritePositionFile(positionFile, pos)
+	}
+
+	out, err := json.Marshal(pos)
 	if err != nil {
-		log.Println(err.Error())
+		return err
 	}
 
+	fmt.Println(string(out))
+
 	return nil
 }
 
@@ -196,7 +256,7 @@ func unLockMyISAMTables(socket string) error {
 	defer func() {
 		err := c.Close()
 		if err != nil {
-			log.Printf("failed to defer: %s\n", err.Error())
+			logging.Warn("defer_failed", "close", nil, 0, err)
 		}
 	}()
 
@@ -229,7 +289,7 @@ func readUnixSocket(l *net.UnixListener) (string, error) {
 	defer func() {
 		err := c.Close()
 		if err != nil {
-			log.Printf("failed to defer: %s\n", err.Error())
+			logging.Warn("defer_failed", "close", nil, 0, err)
 		}
 	}()
 
@@ -243,6 +303,37 @@ func readUnixSocket(l *net.UnixListener) (string, error) {
 	return string(buf[:n]), nil
 }
 
+// secretFilePath returns configured, or the socket path with a ".secret"
+// suffix if configured is empty.
+func secretFilePath(configured string, socket string) string {
+	if configured != "" {
+		return configured
+	}
+
+	return socket + ".secret"
+}
+
+// die logs msg at error level and exits the process with status 1.
+func die(msg string) {
+	logging.Error("fatal", "startup", nil, 0, errors.New(msg))
+	os.Exit(1)
+}
+
+// printIPCResponse prints resp to stdout as JSON, or dies if the server
+// reported a failure.
+func printIPCResponse(resp ipc.Response) {
+	if !resp.OK {
+		die(resp.Error)
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		die(err.Error())
+	}
+
+	fmt.Println(string(out))
+}
+
 func main() {
 
 	unixSocketPath := flag.String("unix-socket-path", "/var/run/mysqld/backup.sock", "unix socket path to use for communication")
@@ -250,49 +341,208 @@ func main() {
 
 	lockPtr := flag.Bool("lock-tables", false, "issue lock to all MyISAM tables")
 	unlockPtr := flag.Bool("unlock-tables", false, "issue unlock to all tables")
+	statusPtr := flag.Bool("status", false, "query the lock status from a running -lock-tables process and print it as JSON")
+	extendLockPtr := flag.Bool("extend-lock", false, "tell a running -lock-tables process the lock should be held longer, and print the updated status as JSON")
+
+	lockModePtr := flag.String("lock-mode", string(lock.ModeMyISAM), "locking mode: myisam, instance, global, or snapshot")
+	positionFilePtr := flag.String("position-file", "", "file to write the captured binlog position and GTID_EXECUTED to (default: print to stdout)")
+
+	secretFilePtr := flag.String("secret-file", "", "path to the HMAC shared secret for the socket protocol (default: <unix-socket-path>.secret)")
+	socketGroupPtr := flag.String("socket-group", "", "group to chown the unix socket to, in addition to mode 0660")
+	legacyProtocolPtr := flag.Bool("legacy-protocol", false, "speak the old unauthenticated fixed-read unix socket protocol instead of the authenticated framed one (deprecated, will be removed)")
+
+	metricsListenPtr := flag.String("metrics-listen", "", "address to serve Prometheus metrics on, e.g. :9200 (default: disabled)")
+
+	runPtr := flag.String("run", "", "acquire the lock, run this shell command (e.g. a backup tool), release the lock, and exit with its exit code")
+	preLockHookPtr := flag.String("pre-lock-hook", "", "shell command to run before the lock is acquired, used with -run")
+	postUnlockHookPtr := flag.String("post-unlock-hook", "", "shell command to run after the lock is released, used with -run")
+	maxLockDurationPtr := flag.Duration("max-lock-duration", 0, "force-unlock and kill the command started by -run if the lock is held longer than this (0 disables the watchdog)")
+
+	var runEnvPtr envFlag
+	flag.Var(&runEnvPtr, "run-env", "additional KEY=VALUE environment variable for the command started by -run, may be repeated")
+
+	dsnPtr := flag.String("dsn", "", "full go-sql-driver/mysql DSN, overrides every other connection flag")
+	hostPtr := flag.String("host", "", "MySQL host, enables a TCP connection (bracket IPv6 addresses, e.g. [::1])")
+	portPtr := flag.String("port", "3306", "MySQL port, used with -host")
+	mysqlSocketPtr := flag.String("mysql-socket", "", "path to a MySQL unix socket, enables a socket connection instead of -host")
+	userPtr := flag.String("user", "", "MySQL user, used with -host")
+	passwordPtr := flag.String("password", "", "MySQL password, used with -host")
+	sslModePtr := flag.String("ssl-mode", "disabled", "TLS mode: disabled, preferred, required, verify_ca, or verify_identity")
+	sslCAPtr := flag.String("ssl-ca", "", "path to the CA certificate bundle for TLS")
+	sslCertPtr := flag.String("ssl-cert", "", "path to the client certificate for TLS")
+	sslKeyPtr := flag.String("ssl-key", "", "path to the client key for TLS")
+	parseTimePtr := flag.Bool("parse-time", false, "parse DATE/DATETIME/TIMESTAMP columns as time.Time")
+	locPtr := flag.String("loc", "", "IANA time zone name used to interpret DATE/DATETIME/TIMESTAMP values")
+	dialTimeoutPtr := flag.Duration("dial-timeout", 0, "connection dial timeout (0 uses the driver default)")
+	readTimeoutPtr := flag.Duration("read-timeout", 0, "connection read timeout (0 uses the driver default)")
+	writeTimeoutPtr := flag.Duration("write-timeout", 0, "connection write timeout (0 uses the driver default)")
+	queryTimeoutPtr := flag.Duration("query-timeout", 30*time.Second, "deadline for connecting, discovering tables, and acquiring the lock, so a hung server can't block forever (0 disables it)")
 
 	flag.Parse()
 
+	if *metricsListenPtr != "" {
+		metrics.Serve(*metricsListenPtr)
+	}
+
+	dsn, err := config.Resolve(config.Options{
+		DSN:              *dsnPtr,
+		Host:             *hostPtr,
+		Port:             *portPtr,
+		Socket:           *mysqlSocketPtr,
+		User:             *userPtr,
+		Password:         *passwordPtr,
+		SSLMode:          *sslModePtr,
+		SSLCA:            *sslCAPtr,
+		SSLCert:          *sslCertPtr,
+		SSLKey:           *sslKeyPtr,
+		ParseTime:        *parseTimePtr,
+		Loc:              *locPtr,
+		Timeout:          *dialTimeoutPtr,
+		ReadTimeout:      *readTimeoutPtr,
+		WriteTimeout:     *writeTimeoutPtr,
+		DebianConfigPath: *debianMysqlConfigPath,
+	})
+	if err != nil {
+		die(err.Error())
+	}
+
 	if *lockPtr {
 
 		err := os.Remove(*unixSocketPath)
 		if err != nil {
-			log.Fatalln(err.Error())
+			die(err.Error())
 		}
 
-		cfgMap, err := readDebianMySQLConfig(*debianMysqlConfigPath)
+		mode, err := lock.ParseMode(*lockModePtr)
 		if err != nil {
-			log.Fatalln(err.Error())
+			die(err.Error())
 		}
 
-		dsn := genDsn(cfgMap)
+		ctx, cancel := withOptionalTimeout(context.Background(), *queryTimeoutPtr)
+		defer cancel()
 
-		tables, err := getMyISAMTables(dsn)
+		tables, err := discoverTables(ctx, dsn, mode)
 		if err != nil {
-			log.Fatalln(err.Error())
+			die(err.Error())
 		}
 
-		err = lockMyISAMTables(dsn, tables, *unixSocketPath)
+		err = lockTables(ctx, dsn, lockOptions{
+			Mode:           mode,
+			Tables:         tables,
+			Socket:         *unixSocketPath,
+			PositionFile:   *positionFilePtr,
+			LegacyProtocol: *legacyProtocolPtr,
+			SecretFile:     secretFilePath(*secretFilePtr, *unixSocketPath),
+			SocketGroup:    *socketGroupPtr,
+		})
 		if err != nil {
-			log.Fatalln(err.Error())
+			die(err.Error())
 		}
 	}
 
 	if *unlockPtr {
-		err := unLockMyISAMTables(*unixSocketPath)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
+		if *legacyProtocolPtr {
+			err := unLockMyISAMTables(*unixSocketPath)
+			if err != nil {
+				die(err.Error())
+			}
 
-		defer func() {
-			err := os.Remove(*unixSocketPath)
+			defer func() {
+				err := os.Remove(*unixSocketPath)
+				if err != nil {
+					logging.Warn("defer_failed", "remove_socket", nil, 0, err)
+				}
+			}()
+		} else {
+			secret, err := ipc.LoadOrCreateSecret(secretFilePath(*secretFilePtr, *unixSocketPath))
 			if err != nil {
-				log.Printf("failed to defer: %s\n", err.Error())
+				die(err.Error())
 			}
-		}()
+
+			resp, err := ipc.Do(*unixSocketPath, secret, ipc.Request{Command: ipc.CommandUnlock})
+			if err != nil {
+				die(err.Error())
+			}
+
+			if !resp.OK {
+				die(resp.Error)
+			}
+		}
+	}
+
+	if *statusPtr {
+		secret, err := ipc.LoadOrCreateSecret(secretFilePath(*secretFilePtr, *unixSocketPath))
+		if err != nil {
+			die(err.Error())
+		}
+
+		resp, err := ipc.Do(*unixSocketPath, secret, ipc.Request{Command: ipc.CommandStatus})
+		if err != nil {
+			die(err.Error())
+		}
+
+		printIPCResponse(resp)
+	}
+
+	if *extendLockPtr {
+		secret, err := ipc.LoadOrCreateSecret(secretFilePath(*secretFilePtr, *unixSocketPath))
+		if err != nil {
+			die(err.Error())
+		}
+
+		resp, err := ipc.Do(*unixSocketPath, secret, ipc.Request{Command: ipc.CommandExtendLock})
+		if err != nil {
+			die(err.Error())
+		}
+
+		printIPCResponse(resp)
+	}
+
+	if *runPtr != "" {
+
+		mode, err := lock.ParseMode(*lockModePtr)
+		if err != nil {
+			die(err.Error())
+		}
+
+		discoverCtx, cancel := withOptionalTimeout(context.Background(), *queryTimeoutPtr)
+
+		tables, err := discoverTables(discoverCtx, dsn, mode)
+
+		cancel()
+
+		if err != nil {
+			die(err.Error())
+		}
+
+		status, err := runner.Run(runner.Options{
+			DSN:             dsn,
+			Tables:          tables,
+			LockMode:        mode,
+			PositionFile:    *positionFilePtr,
+			Command:         *runPtr,
+			Env:             runEnvPtr,
+			PreHook:         *preLockHookPtr,
+			PostHook:        *postUnlockHookPtr,
+			MaxLockDuration: *maxLockDurationPtr,
+			QueryTimeout:    *queryTimeoutPtr,
+		})
+
+		out, jsonErr := json.Marshal(status)
+		if jsonErr != nil {
+			die(jsonErr.Error())
+		}
+
+		fmt.Println(string(out))
+
+		if err != nil {
+			os.Exit(1)
+		}
+
+		os.Exit(status.ExitCode)
 	}
 
-	if !*unlockPtr && !*lockPtr {
+	if !*unlockPtr && !*lockPtr && !*statusPtr && !*extendLockPtr && *runPtr == "" {
 		fmt.Printf("Use %s -h to see all options\n", os.Args[0])
 		os.Exit(0)
 	}
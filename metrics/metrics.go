@@ -0,0 +1,98 @@
+// Package metrics exposes the Prometheus metrics for lock lifecycle
+// observability: whether a lock is currently held, how long locks are held,
+// how many MyISAM tables are in scope per schema, and error/command
+// counters, so multiple nightly backup invocations can be graphed and
+// alerted on.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/s3rj1k/mysql-lock-helper/logging"
+)
+
+var (
+	// LockHeld reports whether a lock is currently held (1) or not (0).
+	LockHeld = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mysql_lock_helper_lock_held",
+		Help: "Whether a lock is currently held by this process (1) or not (0).",
+	})
+
+	// LockDurationSeconds records how long each held lock lasted.
+	LockDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mysql_lock_helper_lock_duration_seconds",
+		Help:    "Duration a lock was held, in seconds.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14), // 1s .. ~4.5h
+	})
+
+	// MyISAMTablesTotal reports the number of MyISAM tables in scope, per
+	// schema.
+	MyISAMTablesTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mysql_lock_helper_myisam_tables_total",
+		Help: "Number of MyISAM tables locked, per schema.",
+	}, []string{"schema"})
+
+	// FlushErrorsTotal counts failures acquiring a lock (FLUSH TABLES,
+	// LOCK INSTANCE FOR BACKUP, or START TRANSACTION WITH CONSISTENT
+	// SNAPSHOT).
+	FlushErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mysql_lock_helper_flush_errors_total",
+		Help: "Number of errors encountered while acquiring a lock.",
+	})
+
+	// SocketCommandsTotal counts ipc commands served, per command.
+	SocketCommandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mysql_lock_helper_socket_commands_total",
+		Help: "Number of ipc commands served over the control socket, per command.",
+	}, []string{"command"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		LockHeld,
+		LockDurationSeconds,
+		MyISAMTablesTotal,
+		FlushErrorsTotal,
+		SocketCommandsTotal,
+	)
+}
+
+// SetMyISAMTablesPerSchema resets MyISAMTablesTotal and repopulates it from
+// tables, each formatted "schema.table".
+func SetMyISAMTablesPerSchema(tables []string) {
+	counts := make(map[string]float64, len(tables))
+
+	for _, table := range tables {
+		schema := table
+
+		if idx := strings.Index(table, "."); idx >= 0 {
+			schema = table[:idx]
+		}
+
+		counts[schema]++
+	}
+
+	MyISAMTablesTotal.Reset()
+
+	for schema, count := range counts {
+		MyISAMTablesTotal.WithLabelValues(schema).Set(count)
+	}
+}
+
+// Serve starts an HTTP server exposing /metrics on addr in the background.
+// A failure to bind is logged; Serve does not block the caller.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Error("metrics_listen_failed", "metrics", nil, 0, err)
+		}
+	}()
+}
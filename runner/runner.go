@@ -0,0 +1,238 @@
+// Package runner implements the backup-orchestration lifecycle: acquire a
+// MyISAM read lock, run pre/post hooks and the caller's backup command, and
+// release the lock deterministically instead of relying on an external
+// process polling a unix socket.
+package runner
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/s3rj1k/mysql-lock-helper/lock"
+	"github.com/s3rj1k/mysql-lock-helper/logging"
+	"github.com/s3rj1k/mysql-lock-helper/metrics"
+)
+
+// Options configures a single orchestrated backup run.
+type Options struct {
+	// DSN is the MySQL data source name used to acquire and release the lock.
+	DSN string
+
+	// Tables is the list of "schema.table" names to lock. Only consulted for
+	// LockMode lock.ModeMyISAM.
+	Tables []string
+
+	// LockMode selects how the server is put into a backup-consistent state.
+	LockMode lock.Mode
+
+	// PositionFile, if set, receives the captured replication position as
+	// JSON. If empty, the position is included in Status instead.
+	PositionFile string
+
+	// Command is executed via "/bin/sh -c" while the lock is held.
+	Command string
+
+	// Env holds additional "KEY=VALUE" entries appended to the command's
+	// environment, on top of the current process environment.
+	Env []string
+
+	// PreHook, if set, is run via "/bin/sh -c" before the lock is acquired.
+	PreHook string
+
+	// PostHook, if set, is run via "/bin/sh -c" after the lock is released.
+	PostHook string
+
+	// MaxLockDuration force-unlocks and kills Command if it hasn't exited by
+	// the time this much time has passed since the lock was acquired. Zero
+	// disables the watchdog.
+	MaxLockDuration time.Duration
+
+	// QueryTimeout bounds connecting, discovering tables, and acquiring the
+	// lock, so a hung server can't block Run forever before any lock is held.
+	// Zero means no deadline. It does not apply once the lock is held.
+	QueryTimeout time.Duration
+}
+
+// Status is the lifecycle result, suitable for JSON encoding to stdout so a
+// backup pipeline can inspect the outcome of a run.
+type Status struct {
+	Tables       []string       `json:"tables"`
+	LockMode     lock.Mode      `json:"lock_mode"`
+	Command      string         `json:"command"`
+	LockAcquired bool           `json:"lock_acquired"`
+	LockedAt     time.Time      `json:"locked_at,omitempty"`
+	UnlockedAt   time.Time      `json:"unlocked_at,omitempty"`
+	LockDuration string         `json:"lock_duration,omitempty"`
+	Position     *lock.Position `json:"position,omitempty"`
+	ExitCode     int            `json:"exit_code"`
+	ForcedUnlock bool           `json:"forced_unlock"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// Run acquires a MyISAM read lock, runs Command for its duration, and
+// releases the lock before returning. The returned Status is always
+// populated, even when err is non-nil, so callers can still emit it.
+func Run(opts Options) (*Status, error) {
+
+	status := &Status{
+		Tables:   opts.Tables,
+		LockMode: opts.LockMode,
+		Command:  opts.Command,
+	}
+
+	if err := runHook(opts.PreHook); err != nil {
+		status.Error = fmt.Sprintf("pre-lock hook: %s", err.Error())
+		return status, fmt.Errorf("pre-lock hook: %w", err)
+	}
+
+	db, err := sql.Open("mysql", opts.DSN)
+	if err != nil {
+		status.Error = err.Error()
+		return status, err
+	}
+
+	defer func() {
+		if cerr := db.Close(); cerr != nil {
+			logging.Warn("defer_failed", "close", nil, 0, cerr)
+		}
+	}()
+
+	ctx := context.Background()
+
+	if opts.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, opts.QueryTimeout)
+		defer cancel()
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		status.Error = err.Error()
+		return status, err
+	}
+
+	lck, err := lock.Acquire(ctx, db, opts.LockMode, opts.Tables)
+	if err != nil {
+		metrics.FlushErrorsTotal.Inc()
+		status.Error = err.Error()
+		return status, err
+	}
+
+	status.LockAcquired = true
+	status.LockedAt = time.Now()
+	metrics.LockHeld.Set(1)
+
+	if opts.LockMode == lock.ModeMyISAM {
+		metrics.SetMyISAMTablesPerSchema(opts.Tables)
+	}
+
+	if pos, err := lock.CapturePosition(ctx, lck.Queryer()); err != nil {
+		logging.Warn("capture_position_failed", "locked", opts.Tables, 0, err)
+	} else {
+		status.Position = pos
+
+		if opts.PositionFile != "" {
+			if err := lock.WritePositionFile(opts.PositionFile, pos); err != nil {
+				logging.Warn("write_position_file_failed", "locked", opts.Tables, 0, err)
+			}
+		}
+	}
+
+	logging.Info("lock_acquired", "locked", opts.Tables, 0, nil)
+
+	defer func() {
+		status.UnlockedAt = time.Now()
+		lockDuration := status.UnlockedAt.Sub(status.LockedAt)
+		status.LockDuration = lockDuration.String()
+		metrics.LockHeld.Set(0)
+		metrics.LockDurationSeconds.Observe(lockDuration.Seconds())
+
+		if err := lck.Release(); err != nil {
+			logging.Warn("release_lock_failed", "unlock", opts.Tables, 0, err)
+		} else {
+			logging.Info("lock_released", "unlock", opts.Tables, lockDuration, nil)
+		}
+
+		if err := runHook(opts.PostHook); err != nil {
+			logging.Warn("post_unlock_hook_failed", "unlock", nil, 0, err)
+		}
+	}()
+
+	cmd := exec.Command("/bin/sh", "-c", opts.Command)
+	cmd.Env = append(os.Environ(), opts.Env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		status.Error = err.Error()
+		return status, err
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var watchdog <-chan time.Time
+
+	if opts.MaxLockDuration > 0 {
+		timer := time.NewTimer(opts.MaxLockDuration)
+		defer timer.Stop()
+
+		watchdog = timer.C
+	}
+
+	select {
+	case waitErr := <-done:
+		status.ExitCode = exitCode(waitErr)
+	case <-watchdog:
+		status.ForcedUnlock = true
+
+		if err := cmd.Process.Kill(); err != nil {
+			logging.Warn("kill_child_failed", "watchdog", nil, 0, err)
+		}
+
+		<-done
+
+		status.ExitCode = -1
+		status.Error = fmt.Sprintf("max lock duration of %s exceeded, child process killed", opts.MaxLockDuration)
+	}
+
+	return status, nil
+}
+
+// exitCode extracts a child process exit code from the error returned by
+// (*exec.Cmd).Wait, returning 0 for a nil error and -1 when the code can't
+// be determined (e.g. the process was killed by a signal).
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return -1
+}
+
+// runHook runs command via "/bin/sh -c" and waits for it to exit. An empty
+// command is a no-op.
+func runHook(command string) error {
+	if command == "" {
+		return nil
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
@@ -0,0 +1,32 @@
+package runner
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestExitCodeNilError(t *testing.T) {
+	if got := exitCode(nil); got != 0 {
+		t.Errorf("exitCode(nil) = %d, want 0", got)
+	}
+}
+
+func TestExitCodeExitError(t *testing.T) {
+	// "sh -c exit 3" reliably produces an *exec.ExitError with code 3.
+	err := exec.Command("/bin/sh", "-c", "exit 3").Run()
+
+	if got := exitCode(err); got != 3 {
+		t.Errorf("exitCode(%v) = %d, want 3", err, got)
+	}
+}
+
+func TestExitCodeNonExitError(t *testing.T) {
+	_, err := exec.LookPath("definitely-not-a-real-command")
+	if err == nil {
+		t.Skip("expected exec.LookPath to fail for a nonexistent command")
+	}
+
+	if got := exitCode(err); got != -1 {
+		t.Errorf("exitCode(%v) = %d, want -1", err, got)
+	}
+}